@@ -1,40 +1,145 @@
 package microsoft
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 const scope = "http://api.microsofttranslator.com"
 
+// defaultRefreshWithin is how far ahead of ExpiresAt the background
+// refresher tries to renew the token, and how Azure AD's own
+// tokenRequester example is tuned.
+const defaultRefreshWithin = 5 * time.Minute
+
+// backgroundRefreshInterval is how often the background refresher checks
+// whether the current token has entered its RefreshWithin window.
+const backgroundRefreshInterval = 30 * time.Second
+
+// defaultMaxRetries caps how many times a failed token request is retried
+// before RefreshAccessToken gives up and returns the last error.
+const defaultMaxRetries = 3
+
 type Authenticator interface {
 	Authenticate(request *http.Request) error
+	AuthenticateContext(ctx context.Context, request *http.Request) error
 }
 
 type authenticator struct {
-	provider        AuthenticationProvider
-	accessTokenChan chan *accessToken
+	provider      AuthenticationProvider
+	tokenStore    TokenStore
+	refreshWithin time.Duration
+	httpClient    *http.Client
+	logger        Logger
+	maxRetries    int
+	group         singleflight.Group
+
+	mu    sync.RWMutex
+	token *accessToken
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Option customizes an authenticator created by newAuthenticator.
+type Option func(*authenticator)
+
+// WithTokenStore makes the authenticator load its initial token from, and
+// persist refreshed tokens to, store instead of keeping them only in memory.
+func WithTokenStore(store TokenStore) Option {
+	return func(a *authenticator) {
+		a.tokenStore = store
+	}
+}
+
+// WithRefreshWithin changes how far ahead of expiry the background
+// refresher renews the token. The default is 5 minutes.
+func WithRefreshWithin(d time.Duration) Option {
+	return func(a *authenticator) {
+		a.refreshWithin = d
+	}
 }
 
-func newAuthenticator(clientId, clientSecret string) Authenticator {
-	// make buffered accessToken channel an pre-fill it with an expired token
-	tokenChan := make(chan *accessToken, 1)
-	tokenChan <- &accessToken{}
+// WithHTTPClient overrides the *http.Client used to talk to the token
+// endpoint. The default is http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(a *authenticator) {
+		a.httpClient = client
+	}
+}
 
-	// return new authenticator that uses the above accessToken channel
-	return &authenticator{
-		provider:        newAuthenticationProvider(clientId, clientSecret),
-		accessTokenChan: tokenChan,
+// WithLogger overrides where the authenticator logs transient errors. The
+// default logs to the standard library's log package.
+func WithLogger(logger Logger) Option {
+	return func(a *authenticator) {
+		a.logger = logger
 	}
 }
 
+// WithMaxRetries caps how many times a token request is retried after a
+// network error or a retryable (5xx/429) response. The default is 3.
+func WithMaxRetries(n int) Option {
+	return func(a *authenticator) {
+		a.maxRetries = n
+	}
+}
+
+// NewDataMarketAuthenticator returns an Authenticator using the legacy
+// DataMarket OAuth flow: client_id/client_secret posted as
+// client_credentials (or refresh_token, once available) to
+// datamarket.accesscontrol.windows.net.
+//
+// Deprecated: Microsoft decommissioned the DataMarket flow for the
+// Translator Text API. Use NewSubscriptionKeyAuthenticator or
+// NewCognitiveServicesAuthenticator instead.
+func NewDataMarketAuthenticator(clientId, clientSecret string, opts ...Option) Authenticator {
+	return newAuthenticator(clientId, clientSecret, opts...)
+}
+
+func newAuthenticator(clientId, clientSecret string, opts ...Option) Authenticator {
+	a := &authenticator{
+		tokenStore:    NewMemoryTokenStore(),
+		refreshWithin: defaultRefreshWithin,
+		httpClient:    http.DefaultClient,
+		logger:        defaultLogger{},
+		maxRetries:    defaultMaxRetries,
+		done:          make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	a.provider = newAuthenticationProvider(clientId, clientSecret, a.httpClient, a.logger, a.maxRetries)
+
+	// seed the cached token with whatever the store has; a nil or expired
+	// token just means the first Authenticate call refreshes it
+	if token, err := a.tokenStore.Load(context.Background()); err == nil {
+		a.token = token
+	}
+
+	go a.refreshLoop()
+
+	return a
+}
+
 func (a *authenticator) Authenticate(request *http.Request) error {
-	authToken, err := a.authToken()
+	return a.AuthenticateContext(request.Context(), request)
+}
+
+func (a *authenticator) AuthenticateContext(ctx context.Context, request *http.Request) error {
+	authToken, err := a.authToken(ctx)
 	if err != nil {
 		return err
 	}
@@ -43,32 +148,107 @@ func (a *authenticator) Authenticate(request *http.Request) error {
 	return nil
 }
 
-func (a *authenticator) authToken() (string, error) {
-	// grab the token
-	accessToken := <-a.accessTokenChan
+// Close stops the background refresher. It does not cancel any in-flight
+// HTTP requests made by Authenticate.
+func (a *authenticator) Close() error {
+	a.closeOnce.Do(func() { close(a.done) })
+	return nil
+}
+
+func (a *authenticator) currentToken() *accessToken {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.token
+}
 
-	// make sure it's valid, otherwise request a new one
-	if accessToken == nil || accessToken.expired() {
-		err := a.provider.RefreshAccessToken(accessToken)
-		if err != nil || accessToken == nil {
-			a.accessTokenChan <- nil
+func (a *authenticator) authToken(ctx context.Context) (string, error) {
+	token := a.currentToken()
+
+	if token == nil || token.expired() {
+		var err error
+		token, err = a.refresh(ctx)
+		if err != nil {
 			return "", err
 		}
 	}
 
-	// put the token back on the channel
-	a.accessTokenChan <- accessToken
+	return "Bearer " + token.Token, nil
+}
+
+// refresh fetches a new token, coalescing concurrent callers behind a
+// single HTTP round-trip via the singleflight.Group.
+func (a *authenticator) refresh(ctx context.Context) (*accessToken, error) {
+	before := a.currentToken()
+
+	v, err, _ := a.group.Do("token", func() (interface{}, error) {
+		// someone else may have already refreshed between our caller
+		// deciding a refresh was needed and us entering the group
+		if current := a.currentToken(); current != before {
+			return current, nil
+		}
+
+		// always refresh into a fresh token rather than mutating the one
+		// still exposed through a.token, so concurrent readers of the old
+		// pointer never observe a half-written struct
+		token := &accessToken{}
+		if before != nil {
+			token.RefreshToken = before.RefreshToken
+		}
+
+		if err := a.provider.RefreshAccessToken(ctx, token); err != nil {
+			return nil, err
+		}
+
+		if err := a.tokenStore.Save(ctx, token); err != nil {
+			a.logger.Println("microsoft: saving token failed:", err)
+		}
+
+		a.mu.Lock()
+		a.token = token
+		a.mu.Unlock()
+
+		return token, nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	// return authToken
-	return "Bearer " + accessToken.Token, nil
+	return v.(*accessToken), nil
+}
+
+// refreshLoop proactively renews the token once it enters the
+// RefreshWithin window, so callers on the request path rarely block on an
+// HTTP round-trip.
+func (a *authenticator) refreshLoop() {
+	ticker := time.NewTicker(backgroundRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			token := a.currentToken()
+			if token == nil {
+				continue
+			}
+			if time.Until(token.ExpiresAt) > a.refreshWithin {
+				continue
+			}
+			if _, err := a.refresh(context.Background()); err != nil {
+				a.logger.Println("microsoft: background token refresh failed:", err)
+			}
+		case <-a.done:
+			return
+		}
+	}
 }
 
 type accessToken struct {
-	Token     string `json:"access_token"`
-	Type      string `json:"token_type"`
-	Scope     string `json:"scope"`
-	ExpiresIn string `json:"expires_in"`
-	ExpiresAt time.Time
+	Token        string `json:"access_token"`
+	Type         string `json:"token_type"`
+	Scope        string `json:"scope"`
+	ExpiresIn    string `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    time.Time
 }
 
 func (t *accessToken) expired() bool {
@@ -77,55 +257,172 @@ func (t *accessToken) expired() bool {
 }
 
 type AuthenticationProvider interface {
-	RefreshAccessToken(*accessToken) error
+	RefreshAccessToken(ctx context.Context, token *accessToken) error
 }
 
 type authenticationProvider struct {
 	clientId     string
 	clientSecret string
 	router       Router
+	httpClient   *http.Client
+	logger       Logger
+	maxRetries   int
 }
 
-func newAuthenticationProvider(clientId, clientSecret string) AuthenticationProvider {
+func newAuthenticationProvider(clientId, clientSecret string, httpClient *http.Client, logger Logger, maxRetries int) AuthenticationProvider {
 	return &authenticationProvider{
 		clientId:     clientId,
 		clientSecret: clientSecret,
 		router:       newRouter(),
+		httpClient:   httpClient,
+		logger:       logger,
+		maxRetries:   maxRetries,
 	}
 }
 
-func (p *authenticationProvider) RefreshAccessToken(token *accessToken) error {
+func (p *authenticationProvider) RefreshAccessToken(ctx context.Context, token *accessToken) error {
+	if token != nil && token.RefreshToken != "" {
+		values := p.grantValues("refresh_token", token.RefreshToken)
+		if err := p.requestTokenWithRetry(ctx, values, token); err == nil {
+			return nil
+		}
+		// the refresh token may be expired or revoked; fall back to
+		// client_credentials rather than surface the error
+	}
+
+	values := p.grantValues("client_credentials", "")
+	return p.requestTokenWithRetry(ctx, values, token)
+}
+
+func (p *authenticationProvider) grantValues(grantType, refreshToken string) url.Values {
 	values := make(url.Values)
 	values.Set("client_id", p.clientId)
 	values.Set("client_secret", p.clientSecret)
 	values.Set("scope", scope)
-	values.Set("grant_type", "client_credentials")
+	values.Set("grant_type", grantType)
+	if refreshToken != "" {
+		values.Set("refresh_token", refreshToken)
+	}
+	return values
+}
+
+// requestTokenWithRetry retries transient failures with exponential
+// backoff and jitter, honoring any Retry-After the server sends, and
+// returns immediately on a fatal OAuthError such as invalid_client.
+func (p *authenticationProvider) requestTokenWithRetry(ctx context.Context, values url.Values, token *accessToken) error {
+	return retryWithBackoff(ctx, p.maxRetries, p.logger, func() (time.Duration, error) {
+		return p.requestToken(ctx, values, token)
+	})
+}
+
+// retryWithBackoff calls fn until it succeeds, retries are exhausted, or
+// fn returns a fatal *OAuthError (e.g. invalid_client/invalid_grant),
+// which is returned immediately without retrying. fn reports how long the
+// server asked us to wait (zero if it didn't say), which takes priority
+// over the exponential backoff+jitter schedule. Shared by the OAuth token
+// endpoint and the Cognitive Services issueToken endpoint.
+func retryWithBackoff(ctx context.Context, maxRetries int, logger Logger, fn func() (time.Duration, error)) error {
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var oauthErr *OAuthError
+		if errors.As(err, &oauthErr) && oauthErr.fatal() {
+			return err
+		}
+
+		if attempt >= maxRetries {
+			return err
+		}
+
+		wait := retryAfter
+		if wait <= 0 {
+			wait = backoff(attempt)
+		}
+
+		logger.Println("microsoft: retrying token request:", err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// backoff returns an exponentially increasing delay with jitter, starting
+// around 200ms and doubling on each attempt.
+func backoff(attempt int) time.Duration {
+	base := 200 * time.Millisecond << uint(attempt)
+	return base/2 + time.Duration(rand.Int63n(int64(base)/2+1))
+}
 
-	response, err := http.PostForm(p.router.AuthUrl(), values)
+// requestToken performs a single token request. It returns the server's
+// Retry-After duration (zero if absent) alongside any error, so the caller
+// can honor it when scheduling a retry.
+func (p *authenticationProvider) requestToken(ctx context.Context, values url.Values, token *accessToken) (time.Duration, error) {
+	request, err := http.NewRequest(http.MethodPost, p.router.AuthUrl(), strings.NewReader(values.Encode()))
 	if err != nil {
-		log.Println(err)
-		return err
+		return 0, err
 	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	body, err := ioutil.ReadAll(response.Body)
+	response, err := p.httpClient.Do(request)
+	if err != nil {
+		p.logger.Println("microsoft: token request failed:", err)
+		return 0, err
+	}
 	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		log.Println(err)
-		return err
+		p.logger.Println("microsoft: reading token response failed:", err)
+		return 0, err
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		oauthErr := &OAuthError{HTTPStatus: response.StatusCode}
+		if err := json.Unmarshal(body, oauthErr); err != nil {
+			oauthErr.Description = string(body)
+		}
+		p.logger.Println("microsoft: token request returned an error:", oauthErr)
+		return retryAfter(response.Header), oauthErr
 	}
 
 	if err := json.Unmarshal(body, token); err != nil {
-		log.Println(err)
-		return err
+		p.logger.Println("microsoft: decoding token response failed:", err)
+		return 0, err
 	}
 
 	expiresInSeconds, err := strconv.Atoi(token.ExpiresIn)
 	if err != nil {
-		log.Println(err)
-		return err
+		p.logger.Println("microsoft: parsing expires_in failed:", err)
+		return 0, err
 	}
 
 	token.ExpiresAt = time.Now().Add(time.Duration(expiresInSeconds) * time.Second)
 
-	return nil
+	return 0, nil
+}
+
+// retryAfter parses the Retry-After header, which the RFC allows as either
+// a number of seconds or an HTTP date.
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+
+	return 0
 }
@@ -0,0 +1,18 @@
+package microsoft
+
+import "log"
+
+// Logger is the logging interface used throughout this package. It is
+// satisfied by *log.Logger, so library users can pass one of their own, or
+// implement it to route output through whatever logging framework they use.
+type Logger interface {
+	Println(v ...interface{})
+}
+
+// defaultLogger preserves the package's historical behaviour of logging to
+// the standard logger when the caller does not configure one.
+type defaultLogger struct{}
+
+func (defaultLogger) Println(v ...interface{}) {
+	log.Println(v...)
+}
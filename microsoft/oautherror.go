@@ -0,0 +1,31 @@
+package microsoft
+
+import "fmt"
+
+// OAuthError is the RFC 6749 section 5.2 error response returned by the
+// token endpoint, augmented with the HTTP status it arrived with so callers
+// can tell a fatal "invalid_client" from a retryable 503.
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+	URI         string `json:"error_uri"`
+	HTTPStatus  int    `json:"-"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("microsoft: %s: %s (http %d)", e.Code, e.Description, e.HTTPStatus)
+	}
+	return fmt.Sprintf("microsoft: oauth error %q (http %d)", e.Code, e.HTTPStatus)
+}
+
+// fatal reports whether the error indicates the credentials themselves are
+// bad, so retrying the same request would never succeed.
+func (e *OAuthError) fatal() bool {
+	switch e.Code {
+	case "invalid_client", "invalid_grant":
+		return true
+	default:
+		return false
+	}
+}
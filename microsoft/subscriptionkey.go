@@ -0,0 +1,240 @@
+package microsoft
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cognitiveServicesTokenTTL is the fallback cache lifetime used if a JWT's
+// own exp claim can't be parsed. The tokens the issueToken endpoint hands
+// out are valid for 10 minutes; we treat them as expired a minute early.
+const cognitiveServicesTokenTTL = 9 * time.Minute
+
+// subscriptionKeyAuthenticator authenticates by sending the Cognitive
+// Services subscription key directly, with no token round-trip at all.
+type subscriptionKeyAuthenticator struct {
+	key    string
+	region string
+}
+
+// NewSubscriptionKeyAuthenticator returns an Authenticator that sets the
+// Ocp-Apim-Subscription-Key header (and Ocp-Apim-Subscription-Region, for
+// regional resources) on every request. This is the simplest way to
+// authenticate against the current Translator Text API.
+func NewSubscriptionKeyAuthenticator(key, region string) Authenticator {
+	return &subscriptionKeyAuthenticator{key: key, region: region}
+}
+
+func (a *subscriptionKeyAuthenticator) Authenticate(request *http.Request) error {
+	return a.AuthenticateContext(request.Context(), request)
+}
+
+func (a *subscriptionKeyAuthenticator) AuthenticateContext(ctx context.Context, request *http.Request) error {
+	request.Header.Set("Ocp-Apim-Subscription-Key", a.key)
+	if a.region != "" {
+		request.Header.Set("Ocp-Apim-Subscription-Region", a.region)
+	}
+	return nil
+}
+
+// cognitiveServicesAuthenticator exchanges a subscription key for a
+// short-lived JWT via the region's issueToken endpoint and caches it until
+// shortly before it expires.
+type cognitiveServicesAuthenticator struct {
+	key        string
+	region     string
+	router     Router
+	httpClient *http.Client
+	logger     Logger
+	maxRetries int
+	group      singleflight.Group
+
+	mu        sync.RWMutex
+	jwt       string
+	expiresAt time.Time
+}
+
+// CognitiveServicesOption customizes an Authenticator created by
+// NewCognitiveServicesAuthenticator.
+type CognitiveServicesOption func(*cognitiveServicesAuthenticator)
+
+// WithCognitiveServicesHTTPClient overrides the *http.Client used to call
+// the issueToken endpoint. The default is http.DefaultClient.
+func WithCognitiveServicesHTTPClient(client *http.Client) CognitiveServicesOption {
+	return func(a *cognitiveServicesAuthenticator) {
+		a.httpClient = client
+	}
+}
+
+// WithCognitiveServicesLogger overrides where the authenticator logs
+// transient errors. The default logs to the standard library's log
+// package.
+func WithCognitiveServicesLogger(logger Logger) CognitiveServicesOption {
+	return func(a *cognitiveServicesAuthenticator) {
+		a.logger = logger
+	}
+}
+
+// WithCognitiveServicesMaxRetries caps how many times an issueToken
+// request is retried after a network error or a retryable (5xx/429)
+// response. The default is 3.
+func WithCognitiveServicesMaxRetries(n int) CognitiveServicesOption {
+	return func(a *cognitiveServicesAuthenticator) {
+		a.maxRetries = n
+	}
+}
+
+// NewCognitiveServicesAuthenticator returns an Authenticator that trades
+// the subscription key for a bearer JWT at
+// https://<region>.api.cognitive.microsoft.com/sts/v1.0/issueToken and
+// caches it for the lifetime of the token.
+func NewCognitiveServicesAuthenticator(key, region string, opts ...CognitiveServicesOption) Authenticator {
+	a := &cognitiveServicesAuthenticator{
+		key:        key,
+		region:     region,
+		router:     newRouter(),
+		httpClient: http.DefaultClient,
+		logger:     defaultLogger{},
+		maxRetries: defaultMaxRetries,
+	}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	return a
+}
+
+func (a *cognitiveServicesAuthenticator) Authenticate(request *http.Request) error {
+	return a.AuthenticateContext(request.Context(), request)
+}
+
+func (a *cognitiveServicesAuthenticator) AuthenticateContext(ctx context.Context, request *http.Request) error {
+	jwt, err := a.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+jwt)
+	return nil
+}
+
+func (a *cognitiveServicesAuthenticator) token(ctx context.Context) (string, error) {
+	if jwt, ok := a.cachedToken(); ok {
+		return jwt, nil
+	}
+
+	v, err, _ := a.group.Do("token", func() (interface{}, error) {
+		if jwt, ok := a.cachedToken(); ok {
+			return jwt, nil
+		}
+
+		var jwt string
+		err := retryWithBackoff(ctx, a.maxRetries, a.logger, func() (time.Duration, error) {
+			var retryAfter time.Duration
+			var err error
+			jwt, retryAfter, err = a.issueToken(ctx)
+			return retryAfter, err
+		})
+		if err != nil {
+			return "", err
+		}
+
+		expiresAt, err := jwtExpiry(jwt)
+		if err != nil {
+			a.logger.Println("microsoft: parsing JWT expiry failed, falling back to default TTL:", err)
+			expiresAt = time.Now().Add(cognitiveServicesTokenTTL)
+		} else {
+			// be conservative and treat the token as expired a minute early
+			expiresAt = expiresAt.Add(-time.Minute)
+		}
+
+		a.mu.Lock()
+		a.jwt = jwt
+		a.expiresAt = expiresAt
+		a.mu.Unlock()
+
+		return jwt, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return v.(string), nil
+}
+
+func (a *cognitiveServicesAuthenticator) cachedToken() (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.jwt, a.jwt != "" && time.Now().Before(a.expiresAt)
+}
+
+// issueToken performs a single issueToken request. It returns the
+// server's Retry-After duration (zero if absent) alongside any error, so
+// retryWithBackoff can honor it when scheduling a retry.
+func (a *cognitiveServicesAuthenticator) issueToken(ctx context.Context) (string, time.Duration, error) {
+	request, err := http.NewRequest(http.MethodPost, a.router.IssueTokenUrl(a.region), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Ocp-Apim-Subscription-Key", a.key)
+	request.Header.Set("Content-Length", "0")
+
+	response, err := a.httpClient.Do(request)
+	if err != nil {
+		a.logger.Println("microsoft: issueToken request failed:", err)
+		return "", 0, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		a.logger.Println("microsoft: reading issueToken response failed:", err)
+		return "", 0, err
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		err := fmt.Errorf("microsoft: issueToken returned http %d: %s", response.StatusCode, body)
+		a.logger.Println(err)
+		return "", retryAfter(response.Header), err
+	}
+
+	return strings.TrimSpace(string(body)), 0, nil
+}
+
+// jwtExpiry decodes the exp claim from a JWT's payload segment without
+// validating its signature; the issueToken endpoint is the one we just
+// called over TLS, so there is nothing to verify it against.
+func jwtExpiry(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("microsoft: malformed JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, err
+	}
+	if claims.Exp == 0 {
+		return time.Time{}, fmt.Errorf("microsoft: JWT has no exp claim")
+	}
+
+	return time.Unix(claims.Exp, 0), nil
+}
@@ -0,0 +1,113 @@
+package microsoft
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// TokenStore persists the access token between uses so that long-running
+// processes, or cooperating processes sharing a file, can survive restarts
+// without a fresh OAuth round-trip.
+type TokenStore interface {
+	Load(ctx context.Context) (*accessToken, error)
+	Save(ctx context.Context, token *accessToken) error
+}
+
+// memoryTokenStore is the default TokenStore: it keeps the token in memory
+// for the lifetime of the authenticator and does not persist it anywhere.
+type memoryTokenStore struct {
+	mu    sync.Mutex
+	token *accessToken
+}
+
+// NewMemoryTokenStore returns a TokenStore that keeps the token in memory
+// only. This is the default used when no TokenStore is configured.
+func NewMemoryTokenStore() TokenStore {
+	return &memoryTokenStore{}
+}
+
+func (s *memoryTokenStore) Load(ctx context.Context) (*accessToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token, nil
+}
+
+func (s *memoryTokenStore) Save(ctx context.Context, token *accessToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+	return nil
+}
+
+// fileTokenStore persists the token as JSON at path, letting cooperating
+// processes share it across restarts.
+type fileTokenStore struct {
+	path string
+}
+
+// NewFileTokenStore returns a TokenStore backed by the JSON file at path.
+// The file is created on the first Save and is not required to exist
+// beforehand; a missing file is treated as "no token yet" by Load.
+func NewFileTokenStore(path string) TokenStore {
+	return &fileTokenStore{path: path}
+}
+
+func (s *fileTokenStore) Load(ctx context.Context) (*accessToken, error) {
+	body, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	token := &accessToken{}
+	if err := json.Unmarshal(body, token); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Save writes via a temp file and renames it into place so that a
+// concurrent Load (possibly from another process sharing this path) never
+// observes a partially-written file.
+func (s *fileTokenStore) Save(ctx context.Context, token *accessToken) error {
+	body, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}